@@ -0,0 +1,390 @@
+// Package exposer exposes a CSI VolumeSnapshot as a mountable PVC so its data
+// can be read by a pod in the Velero namespace, e.g. to stream it into the
+// Backup Storage Location via Kopia/Restic instead of leaving it as an
+// in-cluster, cloud-provider-specific snapshot.
+package exposer
+
+import (
+	"context"
+	"math"
+	"time"
+
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned/typed/volumesnapshot/v1beta1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// pauseContainerImage is a minimal image that just sleeps, used for the pod
+	// that holds the exposed PVC mounted so it can be read by a data mover.
+	pauseContainerImage = "velero/velero-plugin-for-csi:pause"
+
+	exposedByAnnotation = "velero.io/exposed-by"
+
+	// exposeKeyLabel carries Param.Key on every object Expose creates.
+	// CleanUp and PeekExposed do not read it; they derive the objects' name
+	// from the key they are given, via exposedName.
+	exposeKeyLabel = "velero.io/csi-expose-key"
+)
+
+// Param carries everything Expose needs to know about the volume being
+// exposed and where it should land in the Velero namespace.
+type Param struct {
+	// Key deterministically and uniquely identifies the volume being exposed
+	// (e.g. derived from the backup name and source PVC namespace/name), and
+	// names every object Expose creates. It is plain caller-chosen data, not
+	// a real Kubernetes object UID.
+	Key string
+	// OwnerPVCName is the name of the source PVC being exposed, recorded on
+	// the exposedByAnnotation for human/debugging purposes.
+	OwnerPVCName string
+	// SourceVolumeSnapshot is the VS produced by the regular CSI backup path.
+	SourceVolumeSnapshot *snapshotv1beta1api.VolumeSnapshot
+	// SourceVolumeSnapshotContent backs SourceVolumeSnapshot.
+	SourceVolumeSnapshotContent *snapshotv1beta1api.VolumeSnapshotContent
+	// VeleroNamespace is where the backup PVC and pause pod are created.
+	VeleroNamespace string
+	// StorageClass is used to provision the backup PVC.
+	StorageClass string
+	// AccessModes are the PVC access modes of the volume being exposed.
+	AccessModes []corev1api.PersistentVolumeAccessMode
+	// Resources is the requested capacity for the backup PVC; it should match
+	// the source PVC's capacity so the restore of the snapshot fits.
+	Resources corev1api.ResourceRequirements
+	// NodeSelector pins the pause pod to the node(s) the original workload's
+	// volume is constrained to, so topology-constrained volumes can bind.
+	NodeSelector map[string]string
+	// Tolerations lets the pause pod land on tainted nodes matching the
+	// original workload.
+	Tolerations []corev1api.Toleration
+	// Timeout bounds how long PeekExposed waits for the PVC and pod to become
+	// ready.
+	Timeout time.Duration
+}
+
+// Result holds the handles created by Expose.
+type Result struct {
+	VolumeSnapshot        *snapshotv1beta1api.VolumeSnapshot
+	VolumeSnapshotContent *snapshotv1beta1api.VolumeSnapshotContent
+	PVC                   *corev1api.PersistentVolumeClaim
+	Pod                   *corev1api.Pod
+}
+
+// Exposer exposes CSI VolumeSnapshots as mountable PVCs in the Velero
+// namespace for consumption by a data mover.
+type Exposer struct {
+	client         corev1client.CoreV1Interface
+	snapshotClient snapshotter.SnapshotV1beta1Interface
+	log            logrus.FieldLogger
+}
+
+// New returns an Exposer backed by the given clients.
+func New(client corev1client.CoreV1Interface, snapshotClient snapshotter.SnapshotV1beta1Interface, log logrus.FieldLogger) *Exposer {
+	return &Exposer{client: client, snapshotClient: snapshotClient, log: log}
+}
+
+// Expose creates a pre-provisioned VolumeSnapshotContent/VolumeSnapshot pair
+// pointing at the same snapshot handle as param.SourceVolumeSnapshotContent,
+// then a PVC sourced from that VolumeSnapshot, then a pause pod mounting the
+// PVC read-only. It returns immediately after issuing the creates; callers
+// should use PeekExposed to wait for everything to become ready.
+func (e *Exposer) Expose(ctx context.Context, param Param) (*Result, error) {
+	if param.SourceVolumeSnapshotContent.Spec.Source.SnapshotHandle == nil {
+		return nil, errors.Errorf("volumesnapshotcontent %s has no snapshot handle to expose", param.SourceVolumeSnapshotContent.Name)
+	}
+
+	name := exposedName(param.Key)
+	deletionPolicy := snapshotv1beta1api.VolumeSnapshotContentRetain
+
+	vsc := &snapshotv1beta1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{exposeKeyLabel: param.Key},
+		},
+		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+			DeletionPolicy:          deletionPolicy,
+			Driver:                  param.SourceVolumeSnapshotContent.Spec.Driver,
+			VolumeSnapshotClassName: param.SourceVolumeSnapshotContent.Spec.VolumeSnapshotClassName,
+			Source: snapshotv1beta1api.VolumeSnapshotContentSource{
+				SnapshotHandle: param.SourceVolumeSnapshotContent.Spec.Source.SnapshotHandle,
+			},
+			VolumeSnapshotRef: corev1api.ObjectReference{
+				APIVersion: "snapshot.storage.k8s.io/v1beta1",
+				Kind:       "VolumeSnapshot",
+				Namespace:  param.VeleroNamespace,
+				Name:       name,
+			},
+		},
+	}
+
+	vsc, err := e.snapshotClient.VolumeSnapshotContents().Create(vsc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating exposing volumesnapshotcontent %s", name)
+	}
+
+	vs := &snapshotv1beta1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: param.VeleroNamespace,
+			Name:      name,
+			Labels:    map[string]string{exposeKeyLabel: param.Key},
+		},
+		Spec: snapshotv1beta1api.VolumeSnapshotSpec{
+			Source: snapshotv1beta1api.VolumeSnapshotSource{
+				VolumeSnapshotContentName: &vsc.Name,
+			},
+			VolumeSnapshotClassName: param.SourceVolumeSnapshotContent.Spec.VolumeSnapshotClassName,
+		},
+	}
+
+	vs, err = e.snapshotClient.VolumeSnapshots(param.VeleroNamespace).Create(vs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating exposing volumesnapshot %s/%s", param.VeleroNamespace, name)
+	}
+
+	pvc, err := e.createBackupPVC(name, vs.Name, param)
+	if err != nil {
+		return nil, err
+	}
+
+	pod, err := e.createPausePod(name, pvc.Name, param)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{VolumeSnapshot: vs, VolumeSnapshotContent: vsc, PVC: pvc, Pod: pod}, nil
+}
+
+func (e *Exposer) createBackupPVC(name, snapshotName string, param Param) (*corev1api.PersistentVolumeClaim, error) {
+	apiGroup := snapshotv1beta1api.GroupName
+
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: param.VeleroNamespace,
+			Name:      name,
+			Labels:    map[string]string{exposeKeyLabel: param.Key},
+			Annotations: map[string]string{
+				exposedByAnnotation: param.OwnerPVCName,
+			},
+		},
+		Spec: corev1api.PersistentVolumeClaimSpec{
+			AccessModes:      param.AccessModes,
+			Resources:        param.Resources,
+			StorageClassName: &param.StorageClass,
+			DataSource: &corev1api.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     snapshotName,
+			},
+		},
+	}
+
+	pvc, err := e.client.PersistentVolumeClaims(param.VeleroNamespace).Create(pvc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating exposing PVC %s/%s", param.VeleroNamespace, name)
+	}
+
+	return pvc, nil
+}
+
+func (e *Exposer) createPausePod(name, pvcName string, param Param) (*corev1api.Pod, error) {
+	pod := &corev1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: param.VeleroNamespace,
+			Name:      name,
+			Labels:    map[string]string{exposeKeyLabel: param.Key},
+		},
+		Spec: corev1api.PodSpec{
+			NodeSelector:  param.NodeSelector,
+			Tolerations:   param.Tolerations,
+			RestartPolicy: corev1api.RestartPolicyNever,
+			Containers: []corev1api.Container{
+				{
+					Name:    "pause",
+					Image:   pauseContainerImage,
+					Command: []string{"sleep", "infinity"},
+					VolumeMounts: []corev1api.VolumeMount{
+						{
+							Name:      "exposed-volume",
+							MountPath: "/mnt/exposed",
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+			Volumes: []corev1api.Volume{
+				{
+					Name: "exposed-volume",
+					VolumeSource: corev1api.VolumeSource{
+						PersistentVolumeClaim: &corev1api.PersistentVolumeClaimVolumeSource{
+							ClaimName: pvcName,
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	pod, err := e.client.Pods(param.VeleroNamespace).Create(pod)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating exposing pod %s/%s", param.VeleroNamespace, name)
+	}
+
+	return pod, nil
+}
+
+// PeekExposed polls until the PVC created by Expose is Bound and its pause
+// pod is Running, or until param.Timeout elapses.
+func (e *Exposer) PeekExposed(ctx context.Context, param Param) error {
+	name := exposedName(param.Key)
+
+	ctx, cancel := context.WithTimeout(ctx, param.Timeout)
+	defer cancel()
+
+	return wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		pvc, err := e.client.PersistentVolumeClaims(param.VeleroNamespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting exposing PVC %s/%s", param.VeleroNamespace, name)
+		}
+		if pvc.Status.Phase != corev1api.ClaimBound {
+			e.log.Infof("Waiting for exposing PVC %s/%s to be bound, currently %s", param.VeleroNamespace, name, pvc.Status.Phase)
+			return false, nil
+		}
+
+		pod, err := e.client.Pods(param.VeleroNamespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting exposing pod %s/%s", param.VeleroNamespace, name)
+		}
+		if pod.Status.Phase != corev1api.PodRunning {
+			e.log.Infof("Waiting for exposing pod %s/%s to be running, currently %s", param.VeleroNamespace, name, pod.Status.Phase)
+			return false, nil
+		}
+
+		return true, nil
+	}, ctx.Done())
+}
+
+// CleanUp removes the pod, PVC, VolumeSnapshot and VolumeSnapshotContent
+// created by Expose for the given key. It tolerates any of them already
+// being gone.
+func (e *Exposer) CleanUp(key string, veleroNamespace string) error {
+	name := exposedName(key)
+
+	if err := e.client.Pods(veleroNamespace).Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting exposing pod %s/%s", veleroNamespace, name)
+	}
+	if err := e.client.PersistentVolumeClaims(veleroNamespace).Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting exposing PVC %s/%s", veleroNamespace, name)
+	}
+	if err := e.snapshotClient.VolumeSnapshots(veleroNamespace).Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting exposing volumesnapshot %s/%s", veleroNamespace, name)
+	}
+	if err := e.snapshotClient.VolumeSnapshotContents().Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting exposing volumesnapshotcontent %s", name)
+	}
+
+	return nil
+}
+
+// RebindVolume is the restore-side counterpart to Expose. A dynamically
+// provisioned PV has an immutable CSI volume handle, so the restored PV
+// created for restoredPVC can never point at the data mover's uploaded
+// volume. Instead RebindVolume deletes that dynamically-provisioned PV
+// (after setting its reclaim policy to Retain and clearing its claimRef so
+// the delete doesn't cascade to the PVC), waits for it to actually
+// disappear (PV deletion is asynchronous on a real cluster, since it can
+// carry finalizers), and creates a statically provisioned replacement with
+// volumeHandle set to snapshotHandle, then rebinds restoredPVC to it by
+// name.
+func (e *Exposer) RebindVolume(ctx context.Context, pvClient corev1client.PersistentVolumesGetter, restoredPVC *corev1api.PersistentVolumeClaim, snapshotHandle string, resources resource.Quantity, timeout time.Duration) error {
+	if restoredPVC.Spec.VolumeName == "" {
+		return errors.Errorf("restored PVC %s/%s has no bound PV to rebind", restoredPVC.Namespace, restoredPVC.Name)
+	}
+
+	pv, err := pvClient.PersistentVolumes().Get(restoredPVC.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting PV %s for restored PVC %s/%s", restoredPVC.Spec.VolumeName, restoredPVC.Namespace, restoredPVC.Name)
+	}
+	if pv.Spec.CSI == nil {
+		return errors.Errorf("PV %s for restored PVC %s/%s is not a CSI volume", pv.Name, restoredPVC.Namespace, restoredPVC.Name)
+	}
+
+	pv.Spec.PersistentVolumeReclaimPolicy = corev1api.PersistentVolumeReclaimRetain
+	pv.Spec.ClaimRef = nil
+	if _, err := pvClient.PersistentVolumes().Update(pv); err != nil {
+		return errors.Wrapf(err, "error setting PV %s to Retain before rebind", pv.Name)
+	}
+
+	if err := pvClient.PersistentVolumes().Delete(pv.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting dynamically-provisioned PV %s", pv.Name)
+	}
+
+	if err := waitForPVDeleted(ctx, pv.Name, pvClient, timeout, e.log); err != nil {
+		return err
+	}
+
+	rebound := pv.DeepCopy()
+	rebound.ResourceVersion = ""
+	rebound.UID = ""
+	rebound.Spec.ClaimRef = &corev1api.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Namespace:  restoredPVC.Namespace,
+		Name:       restoredPVC.Name,
+	}
+	rebound.Spec.CSI.VolumeHandle = snapshotHandle
+	rebound.Spec.Capacity = corev1api.ResourceList{corev1api.ResourceStorage: resources}
+
+	if _, err := pvClient.PersistentVolumes().Create(rebound); err != nil {
+		return errors.Wrapf(err, "error creating rebound PV %s", rebound.Name)
+	}
+
+	return nil
+}
+
+// waitForPVDeleted blocks, with a bounded exponential backoff, until pvName
+// is actually gone from the API server, since PV deletion is asynchronous
+// (finalizers) and the Create that follows it would otherwise race an
+// in-flight delete and fail with AlreadyExists.
+func waitForPVDeleted(ctx context.Context, pvName string, pvClient corev1client.PersistentVolumesGetter, timeout time.Duration, log logrus.FieldLogger) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.2,
+		Cap:      30 * time.Second,
+		Steps:    math.MaxInt32,
+	}
+
+	pollErr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		_, err := pvClient.PersistentVolumes().Get(pvName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get PV %s", pvName)
+		}
+
+		log.Infof("Waiting for PV %s to finish deleting before rebind", pvName)
+		return false, nil
+	})
+
+	if pollErr != nil {
+		return errors.Wrapf(pollErr, "timed out waiting for PV %s to finish deleting", pvName)
+	}
+
+	return nil
+}
+
+func exposedName(key string) string {
+	return "velero-expose-" + key
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned/typed/volumesnapshot/v1beta1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// pvBackupItemAction annotates a CSI-backed PV with the name (and, once
+// ready, the handle) of the VolumeSnapshot that was taken of its bound PVC,
+// so pvRestoreItemAction can find and validate that VolumeSnapshot on
+// restore. Without this, pvRestoreItemAction has nothing to look up.
+type pvBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvBackupItemAction{log: logger}, nil
+}
+
+func (p *pvBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+func (p *pvBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Starting pvBackupItemAction")
+
+	var pv corev1api.PersistentVolume
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pv); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if pv.Spec.CSI == nil {
+		p.log.Infof("PV %s is not a CSI volume, skipping volumesnapshot annotation", pv.Name)
+		return item, nil, nil
+	}
+	if pv.Spec.ClaimRef == nil {
+		p.log.Infof("PV %s has no claimRef, skipping volumesnapshot annotation", pv.Name)
+		return item, nil, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	vs, err := volumeSnapshotForPVC(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, snapshotClient.SnapshotV1beta1())
+	if err != nil {
+		return nil, nil, err
+	}
+	if vs == nil {
+		p.log.Infof("PV %s: no volumesnapshot found yet for PVC %s/%s, skipping volumesnapshot annotation", pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		return item, nil, nil
+	}
+
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[volumeSnapshotNameAnnotation] = vs.Name
+
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		vsc, err := snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Get(*vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error getting volumesnapshotcontent %s for volumesnapshot %s/%s", *vs.Status.BoundVolumeSnapshotContentName, vs.Namespace, vs.Name)
+		}
+		if vsc.Status != nil && vsc.Status.SnapshotHandle != nil {
+			pv.Annotations[volumeSnapshotHandleAnnotation] = *vsc.Status.SnapshotHandle
+		}
+	}
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pv)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: updated}, nil, nil
+}
+
+// volumeSnapshotForPVC returns the first VolumeSnapshot in pvcNamespace whose
+// source is pvcName, or nil if none exists yet. VolumeSnapshots are not
+// filtered by backup; when several exist for the PVC, which one is returned
+// is not defined.
+func volumeSnapshotForPVC(pvcNamespace, pvcName string, snapshotClient snapshotter.SnapshotV1beta1Interface) (*snapshotv1beta1api.VolumeSnapshot, error) {
+	vsList, err := snapshotClient.VolumeSnapshots(pvcNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing volumesnapshots in namespace %s", pvcNamespace)
+	}
+
+	for i, vs := range vsList.Items {
+		if vs.Spec.Source.PersistentVolumeClaimName != nil && *vs.Spec.Source.PersistentVolumeClaimName == pvcName {
+			return &vsList.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
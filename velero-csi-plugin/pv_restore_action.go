@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+const (
+	// volumeSnapshotNameAnnotation and volumeSnapshotHandleAnnotation are set by
+	// pvBackupItemAction on the PV backing a snapshotted PVC, recording which
+	// VolumeSnapshot it restores from and the snapshot handle that VS/VSC pair
+	// must still resolve to at restore time.
+	volumeSnapshotNameAnnotation   = "velero.io/csi-volumesnapshot"
+	volumeSnapshotHandleAnnotation = "velero.io/csi-volumesnapshot-handle"
+)
+
+// pvRestoreItemAction waits for a restored PV's CSI VolumeSnapshot to be
+// ready, and validates its snapshot handle, before the PV is allowed to bind.
+// Without this, a restore whose VolumeSnapshotContent metadata is missing or
+// still reconciling can silently produce an empty, dynamically-provisioned
+// volume instead of failing loudly.
+type pvRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvRestoreItemAction{log: logger}, nil
+}
+
+func (p *pvRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+func (p *pvRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Starting pvRestoreItemAction")
+
+	var pv corev1api.PersistentVolume
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	vsName, ok := pv.Annotations[volumeSnapshotNameAnnotation]
+	if !ok {
+		p.log.Debugf("PV %s has no %s annotation, skipping CSI snapshot readiness check", pv.Name, volumeSnapshotNameAnnotation)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	if pv.Spec.CSI == nil {
+		p.log.Infof("PV %s is not a CSI volume, skipping CSI snapshot readiness check", pv.Name)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return nil, errors.Errorf("PV %s has a %s annotation but no claimRef to determine the restored VolumeSnapshot's namespace", pv.Name, volumeSnapshotNameAnnotation)
+	}
+	vsNamespace := pv.Spec.ClaimRef.Namespace
+
+	expectedHandle := pv.Annotations[volumeSnapshotHandleAnnotation]
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating kube client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	pluginConfig, err := getPluginConfig(input.Restore.Namespace, kubeClient.CoreV1())
+	if err != nil {
+		return nil, err
+	}
+	timeout := snapshotTimeoutForConfig(pluginConfig, p.log)
+
+	vsc, err := waitForVolumeSnapshotReady(context.Background(), vsNamespace, vsName, snapshotClient.SnapshotV1beta1(), timeout, p.log)
+	if err != nil {
+		return nil, errors.Wrapf(err, "PV %s: CSI volumesnapshot %s/%s for driver %s never became ready", pv.Name, vsNamespace, vsName, pv.Spec.CSI.Driver)
+	}
+
+	if expectedHandle != "" && (vsc.Status.SnapshotHandle == nil || *vsc.Status.SnapshotHandle != expectedHandle) {
+		return nil, errors.Errorf("PV %s: volumesnapshotcontent %s for volumesnapshot %s/%s reports snapshot handle %q, expected %q recorded in the backup",
+			pv.Name, vsc.Name, vsNamespace, vsName, derefString(vsc.Status.SnapshotHandle), expectedHandle)
+	}
+
+	p.log.Infof("PV %s: CSI volumesnapshot %s/%s is ready with snapshot handle %q", pv.Name, vsNamespace, vsName, expectedHandle)
+
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	groupsnapshotv1alpha1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumegroupsnapshot/v1alpha1"
+	groupsnapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	groupsnapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumegroupsnapshot/v1alpha1"
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned/typed/volumesnapshot/v1beta1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	veleroclientset "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+const (
+	// volumeGroupAnnotation, set on a PVC, names the group of PVCs that should be
+	// snapshotted together via a single VolumeGroupSnapshot rather than independently.
+	volumeGroupAnnotation = "backup.velero.io/volume-group"
+
+	// volumeGroupLabel is copied onto each member PVC from volumeGroupAnnotation
+	// before a VolumeGroupSnapshot is created. The external-snapshotter
+	// group-snapshot controller selects source PVCs by label, not annotation, so
+	// without this the group snapshot's selector would bind zero (or the wrong)
+	// PVCs even though they're correctly annotated.
+	volumeGroupLabel = "backup.velero.io/volume-group"
+
+	// volumeGroupSnapshotHandleAnnotation and volumeGroupSnapshotDriverAnnotation
+	// are set by this action on the backed-up PVC, recording the snapshot handle
+	// and driver of its own member VolumeSnapshotContent within the group, so
+	// pvcGroupRestoreItemAction can recreate a matching pre-provisioned
+	// VolumeSnapshotContent/VolumeGroupSnapshotContent at restore time.
+	volumeGroupSnapshotHandleAnnotation = "backup.velero.io/volume-group-snapshot-handle"
+	volumeGroupSnapshotDriverAnnotation = "backup.velero.io/volume-group-snapshot-driver"
+)
+
+// pvcGroupBackupItemAction groups PVCs that share a backup.velero.io/volume-group
+// annotation and snapshots them together with a single VolumeGroupSnapshot, so that
+// e.g. a database's data and WAL volumes are captured from the same point in time.
+type pvcGroupBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVCGroupBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvcGroupBackupItemAction{log: logger}, nil
+}
+
+func (p *pvcGroupBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+// Execute finds the other PVCs in the same volume group, creates a single
+// VolumeGroupSnapshot covering all of them (if one hasn't already been created by
+// a group sibling processed earlier in the backup), waits for it to be bound, and
+// then resolves the group's member VolumeSnapshotContents and returns all of them,
+// along with this PVC, as additional items.
+func (p *pvcGroupBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Starting pvcGroupBackupItemAction")
+
+	var pvc corev1api.PersistentVolumeClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pvc); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	groupName, ok := pvc.Annotations[volumeGroupAnnotation]
+	if !ok {
+		p.log.Debugf("PVC %s/%s has no %s annotation, skipping group snapshot handling", pvc.Namespace, pvc.Name, volumeGroupAnnotation)
+		return item, nil, nil
+	}
+
+	p.log.Infof("PVC %s/%s belongs to volume group %s", pvc.Namespace, pvc.Name, groupName)
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating kube client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	groupSnapshotClient, err := groupsnapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating volumegroupsnapshot client")
+	}
+
+	veleroClient, err := veleroclientset.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating velero client")
+	}
+
+	pluginConfig, err := getPluginConfig(backup.Namespace, kubeClient.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selectors := podVolumeBackupSelectorsForConfig(pluginConfig, veleroClient, backup.Name)
+	claimed, err := isPVCBackedUpByPodVolumeBackup(pvc.Namespace, pvc.Name, kubeClient.CoreV1(), selectors)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claimed {
+		p.log.Infof("PVC %s/%s is already being backed up by a pod-volume-backup uploader, skipping group snapshot handling", pvc.Namespace, pvc.Name)
+		return item, nil, nil
+	}
+
+	pv, err := getPVForPVC(&pvc, kubeClient.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+	if pv.Spec.CSI == nil {
+		p.log.Infof("PV %s for PVC %s/%s is not a CSI volume, skipping group snapshot handling", pv.Name, pvc.Namespace, pvc.Name)
+		return item, nil, nil
+	}
+
+	groupSnapName := groupSnapshotName(pvc.Namespace, groupName)
+
+	groupSnap, err := groupSnapshotClient.GroupsnapshotV1alpha1().VolumeGroupSnapshots(pvc.Namespace).Get(groupSnapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		groupSnap, err = createVolumeGroupSnapshot(pvc, pv.Spec.CSI.Driver, groupSnapName, groupName, kubeClient.CoreV1(), groupSnapshotClient.GroupsnapshotV1alpha1(), p.log)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error creating volumegroupsnapshot %s/%s for group %s", pvc.Namespace, groupSnapName, groupName)
+		}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting volumegroupsnapshot %s/%s", pvc.Namespace, groupSnapName)
+	}
+
+	snapshotTimeout := snapshotTimeoutForConfig(pluginConfig, p.log)
+
+	ctx, cancel := contextForBackup(context.Background(), backup, veleroClient, p.log)
+	defer cancel()
+
+	groupContent, err := getVolumeGroupSnapshotContentForVolumeGroupSnapshot(ctx, groupSnap, groupSnapshotClient.GroupsnapshotV1alpha1(), p.log, snapshotTimeout)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error waiting for volumegroupsnapshot %s/%s to be bound", pvc.Namespace, groupSnapName)
+	}
+
+	memberContents, err := memberSnapshotsForGroupContent(groupContent, snapshotClient.SnapshotV1beta1())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error resolving member volumesnapshotcontents for volumegroupsnapshotcontent %s", groupContent.Name)
+	}
+
+	additionalItems := []velero.ResourceIdentifier{
+		{
+			GroupResource: kuberesource.PersistentVolumeClaims,
+			Namespace:     pvc.Namespace,
+			Name:          pvc.Name,
+		},
+	}
+
+	for _, memberContent := range memberContents {
+		additionalItems = append(additionalItems,
+			velero.ResourceIdentifier{
+				GroupResource: kuberesource.VolumeSnapshotContents,
+				Name:          memberContent.Name,
+			},
+		)
+	}
+
+	// Record this PVC's own member snapshot handle and driver on the PVC
+	// itself, since pvcGroupRestoreItemAction has no other way to tell which
+	// of the group's member VolumeSnapshotContents corresponds to it.
+	myContent, err := memberContentForPVC(memberContents, pv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	pvc.Annotations[volumeGroupSnapshotHandleAnnotation] = *myContent.Status.SnapshotHandle
+	pvc.Annotations[volumeGroupSnapshotDriverAnnotation] = myContent.Spec.Driver
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: updated}, additionalItems, nil
+}
+
+// memberContentForPVC finds the VolumeSnapshotContent among memberContents
+// that was dynamically provisioned from pv's own CSI volume handle, which
+// identifies the member snapshot belonging to this specific PVC within the
+// group.
+func memberContentForPVC(memberContents []*snapshotv1beta1api.VolumeSnapshotContent, pv *corev1api.PersistentVolume) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+	for _, content := range memberContents {
+		if content.Spec.Source.VolumeHandle != nil && *content.Spec.Source.VolumeHandle == pv.Spec.CSI.VolumeHandle {
+			if content.Status == nil || content.Status.SnapshotHandle == nil {
+				return nil, errors.Errorf("volumesnapshotcontent %s for PV %s has no snapshot handle yet", content.Name, pv.Name)
+			}
+			return content, nil
+		}
+	}
+	return nil, errors.Errorf("could not find member volumesnapshotcontent for PV %s (volume handle %s) among the group's member snapshots", pv.Name, pv.Spec.CSI.VolumeHandle)
+}
+
+// createVolumeGroupSnapshot builds a VolumeGroupSnapshot selecting all current
+// members of groupName and creates it, keyed by groupSnapName so that whichever
+// group member PVC is processed first by the backup creates the shared object and
+// its siblings simply look it up.
+func createVolumeGroupSnapshot(pvc corev1api.PersistentVolumeClaim, driver, groupSnapName, groupName string, corev1 corev1client.PersistentVolumeClaimsGetter, groupSnapshotClient groupsnapshotter.GroupsnapshotV1alpha1Interface, log logrus.FieldLogger) (*groupsnapshotv1alpha1api.VolumeGroupSnapshot, error) {
+	members, err := groupMemberPVCs(pvc.Namespace, groupName, corev1)
+	if err != nil {
+		return nil, err
+	}
+
+	// The group-snapshot controller selects source PVCs by label, while
+	// volumeGroupAnnotation (the grouping criterion above) is an annotation, so
+	// every member needs volumeGroupLabel copied onto it before the selector
+	// below can find any of them.
+	if err := ensureVolumeGroupLabels(members, groupName, corev1); err != nil {
+		return nil, err
+	}
+
+	groupSnapClass, err := getVolumeGroupSnapshotClassForDriver(driver, groupSnapshotClient)
+	if err != nil {
+		return nil, err
+	}
+
+	groupSnap := &groupsnapshotv1alpha1api.VolumeGroupSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pvc.Namespace,
+			Name:      groupSnapName,
+		},
+		Spec: groupsnapshotv1alpha1api.VolumeGroupSnapshotSpec{
+			VolumeGroupSnapshotClassName: &groupSnapClass.Name,
+			Source: groupsnapshotv1alpha1api.VolumeGroupSnapshotSource{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{volumeGroupLabel: groupName},
+				},
+			},
+		},
+	}
+
+	log.Infof("Creating volumegroupsnapshot %s/%s for %d PVCs in group %s", groupSnap.Namespace, groupSnap.Name, len(members), groupName)
+
+	return groupSnapshotClient.VolumeGroupSnapshots(pvc.Namespace).Create(groupSnap)
+}
+
+// ensureVolumeGroupLabels copies volumeGroupAnnotation's value onto
+// volumeGroupLabel for each member PVC that doesn't already carry it, so the
+// VolumeGroupSnapshot's label selector actually matches them.
+func ensureVolumeGroupLabels(members []corev1api.PersistentVolumeClaim, groupName string, corev1 corev1client.PersistentVolumeClaimsGetter) error {
+	for i := range members {
+		pvc := &members[i]
+		if pvc.Labels[volumeGroupLabel] == groupName {
+			continue
+		}
+
+		updated := pvc.DeepCopy()
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+		updated.Labels[volumeGroupLabel] = groupName
+
+		if _, err := corev1.PersistentVolumeClaims(updated.Namespace).Update(updated); err != nil {
+			return errors.Wrapf(err, "error labeling PVC %s/%s for volume group %s", updated.Namespace, updated.Name, groupName)
+		}
+	}
+
+	return nil
+}
+
+// groupSnapshotName deterministically derives the VolumeGroupSnapshot name shared
+// by all PVCs in a volume group, so that group members agree on it without
+// coordinating out of band.
+func groupSnapshotName(namespace, groupName string) string {
+	return "velero-group-" + namespace + "-" + groupName
+}
+
+// groupMemberPVCs returns all PVCs in the given namespace that share groupName's
+// volumeGroupAnnotation value, sorted by name so that group snapshot creation is
+// deterministic regardless of which member PVC is processed first by the backup.
+func groupMemberPVCs(namespace, groupName string, corev1 corev1client.PersistentVolumeClaimsGetter) ([]corev1api.PersistentVolumeClaim, error) {
+	pvcList, err := corev1.PersistentVolumeClaims(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing PVCs in namespace %s", namespace)
+	}
+
+	var members []corev1api.PersistentVolumeClaim
+	for _, candidate := range pvcList.Items {
+		if candidate.Annotations[volumeGroupAnnotation] == groupName {
+			members = append(members, candidate)
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members, nil
+}
+
+// getVolumeGroupSnapshotClassForDriver returns the first VolumeGroupSnapshotClass
+// whose Driver matches provisioner, analogous to getVolumeSnapshotClassForStorageClass.
+func getVolumeGroupSnapshotClassForDriver(provisioner string, groupSnapshotClient groupsnapshotter.GroupsnapshotV1alpha1Interface) (*groupsnapshotv1alpha1api.VolumeGroupSnapshotClass, error) {
+	classes, err := groupSnapshotClient.VolumeGroupSnapshotClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing volumegroupsnapshot classes")
+	}
+	for _, class := range classes.Items {
+		if class.Driver == provisioner {
+			return &class, nil
+		}
+	}
+	return nil, errors.Errorf("failed to get volumegroupsnapshotclass for provisioner %s", provisioner)
+}
+
+// getVolumeGroupSnapshotContentForVolumeGroupSnapshot blocks until the CSI driver
+// has reconciled groupSnap and bound it to a VolumeGroupSnapshotContent, polling
+// with the same bounded, context-aware exponential backoff as
+// getVolumeSnapshotContentForVolumeSnapshot, instead of looping forever.
+func getVolumeGroupSnapshotContentForVolumeGroupSnapshot(ctx context.Context, groupSnap *groupsnapshotv1alpha1api.VolumeGroupSnapshot, groupSnapshotClient groupsnapshotter.GroupsnapshotV1alpha1Interface, log logrus.FieldLogger, timeout time.Duration) (*groupsnapshotv1alpha1api.VolumeGroupSnapshotContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.2,
+		Cap:      30 * time.Second,
+		Steps:    math.MaxInt32,
+	}
+
+	var content *groupsnapshotv1alpha1api.VolumeGroupSnapshotContent
+
+	pollErr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		gs, err := groupSnapshotClient.VolumeGroupSnapshots(groupSnap.Namespace).Get(groupSnap.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumegroupsnapshot %s/%s", groupSnap.Namespace, groupSnap.Name)
+		}
+
+		if gs.Status == nil || gs.Status.BoundVolumeGroupSnapshotContentName == nil {
+			log.Infof("Waiting for CSI driver to reconcile volumegroupsnapshot %s/%s", groupSnap.Namespace, groupSnap.Name)
+			return false, nil
+		}
+
+		c, err := groupSnapshotClient.VolumeGroupSnapshotContents().Get(*gs.Status.BoundVolumeGroupSnapshotContentName, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumegroupsnapshotcontent %s for volumegroupsnapshot %s/%s", *gs.Status.BoundVolumeGroupSnapshotContentName, groupSnap.Namespace, groupSnap.Name)
+		}
+
+		content = c
+		return true, nil
+	})
+
+	if pollErr != nil {
+		return nil, errors.Wrapf(pollErr, "timed out waiting for volumegroupsnapshot %s/%s to be bound", groupSnap.Namespace, groupSnap.Name)
+	}
+
+	return content, nil
+}
+
+// memberSnapshotsForGroupContent walks content's Status.PVVolumeSnapshotContentList,
+// resolving each member VolumeSnapshotContent. Execute returns these
+// VolumeSnapshotContents as additional items; the members' VolumeSnapshots and
+// VolumeSnapshotClasses are not returned.
+func memberSnapshotsForGroupContent(content *groupsnapshotv1alpha1api.VolumeGroupSnapshotContent, snapshotClient snapshotter.SnapshotV1beta1Interface) ([]*snapshotv1beta1api.VolumeSnapshotContent, error) {
+	var members []*snapshotv1beta1api.VolumeSnapshotContent
+	for _, ref := range content.Status.PVVolumeSnapshotContentList {
+		vsc, err := snapshotClient.VolumeSnapshotContents().Get(ref.VolumeSnapshotContentRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get member volumesnapshotcontent %s for volumegroupsnapshotcontent %s", ref.VolumeSnapshotContentRef.Name, content.Name)
+		}
+		members = append(members, vsc)
+	}
+
+	return members, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	groupsnapshotv1alpha1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumegroupsnapshot/v1alpha1"
+	groupsnapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	groupsnapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumegroupsnapshot/v1alpha1"
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned/typed/volumesnapshot/v1beta1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// pvcGroupRestoreItemAction is the restore-side counterpart to
+// pvcGroupBackupItemAction. For a restored PVC that belonged to a volume
+// group, it recreates the group's shared VolumeGroupSnapshotContent as
+// pre-provisioned (once per group, keyed the same way the backup side keys
+// its VolumeGroupSnapshot) and rebinds this PVC's own member VolumeSnapshot
+// to a pre-provisioned VolumeSnapshotContent carrying the snapshot handle
+// recorded for it at backup time.
+type pvcGroupRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVCGroupRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvcGroupRestoreItemAction{log: logger}, nil
+}
+
+func (p *pvcGroupRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+func (p *pvcGroupRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Starting pvcGroupRestoreItemAction")
+
+	var pvc corev1api.PersistentVolumeClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pvc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	groupName, ok := pvc.Annotations[volumeGroupAnnotation]
+	if !ok {
+		p.log.Debugf("PVC %s/%s has no %s annotation, skipping group snapshot restore handling", pvc.Namespace, pvc.Name, volumeGroupAnnotation)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	handle, ok := pvc.Annotations[volumeGroupSnapshotHandleAnnotation]
+	if !ok {
+		return nil, errors.Errorf("PVC %s/%s belongs to volume group %s but has no %s annotation recording its snapshot handle", pvc.Namespace, pvc.Name, groupName, volumeGroupSnapshotHandleAnnotation)
+	}
+	driver, ok := pvc.Annotations[volumeGroupSnapshotDriverAnnotation]
+	if !ok {
+		return nil, errors.Errorf("PVC %s/%s belongs to volume group %s but has no %s annotation recording its driver", pvc.Namespace, pvc.Name, groupName, volumeGroupSnapshotDriverAnnotation)
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	groupSnapshotClient, err := groupsnapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating volumegroupsnapshot client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	groupContentName := groupSnapshotName(pvc.Namespace, groupName)
+
+	if err := recreateVolumeGroupSnapshotContent(groupContentName, driver, groupSnapshotClient.GroupsnapshotV1alpha1()); err != nil {
+		return nil, errors.Wrapf(err, "error recreating volumegroupsnapshotcontent %s for group %s", groupContentName, groupName)
+	}
+
+	vsName := groupContentName + "-" + pvc.Name
+	if err := rebindMemberVolumeSnapshot(pvc.Namespace, vsName, driver, handle, snapshotClient.SnapshotV1beta1()); err != nil {
+		return nil, errors.Wrapf(err, "error rebinding member volumesnapshot %s/%s for restored PVC %s/%s", pvc.Namespace, vsName, pvc.Namespace, pvc.Name)
+	}
+
+	p.log.Infof("PVC %s/%s: rebuilt group snapshot content %s and rebound member volumesnapshot %s/%s with handle %q", pvc.Namespace, pvc.Name, groupContentName, pvc.Namespace, vsName, handle)
+
+	// The original PVC never had spec.dataSource set (it was an ordinary,
+	// non-snapshot-provisioned claim), so without setting it here the CSI
+	// provisioner would dynamically create a brand-new empty volume on
+	// restore and silently ignore the volumesnapshot rebuilt above.
+	apiGroup := snapshotv1beta1api.GroupName
+	pvc.Spec.DataSource = &corev1api.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     "VolumeSnapshot",
+		Name:     vsName,
+	}
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: updated}), nil
+}
+
+// recreateVolumeGroupSnapshotContent creates a pre-provisioned
+// VolumeGroupSnapshotContent for a restored volume group, keyed by name so
+// whichever member PVC in the group is restored first creates it and its
+// siblings simply find it already there.
+func recreateVolumeGroupSnapshotContent(name, driver string, groupSnapshotClient groupsnapshotter.GroupsnapshotV1alpha1Interface) error {
+	content := &groupsnapshotv1alpha1api.VolumeGroupSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: groupsnapshotv1alpha1api.VolumeGroupSnapshotContentSpec{
+			DeletionPolicy: groupsnapshotv1alpha1api.VolumeGroupSnapshotContentRetain,
+			Driver:         driver,
+		},
+	}
+
+	if _, err := groupSnapshotClient.VolumeGroupSnapshotContents().Create(content); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// rebindMemberVolumeSnapshot creates (or finds) the per-member, pre-provisioned
+// VolumeSnapshotContent/VolumeSnapshot pair for a restored PVC in a volume
+// group, carrying the member's originally recorded snapshot handle.
+func rebindMemberVolumeSnapshot(namespace, vsName, driver, handle string, snapshotClient snapshotter.SnapshotV1beta1Interface) error {
+	vsc := &snapshotv1beta1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: vsName},
+		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+			DeletionPolicy: snapshotv1beta1api.VolumeSnapshotContentRetain,
+			Driver:         driver,
+			Source:         snapshotv1beta1api.VolumeSnapshotContentSource{SnapshotHandle: &handle},
+			VolumeSnapshotRef: corev1api.ObjectReference{
+				APIVersion: "snapshot.storage.k8s.io/v1beta1",
+				Kind:       "VolumeSnapshot",
+				Namespace:  namespace,
+				Name:       vsName,
+			},
+		},
+	}
+	if _, err := snapshotClient.VolumeSnapshotContents().Create(vsc); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating volumesnapshotcontent %s", vsName)
+	}
+
+	vs := &snapshotv1beta1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: vsName},
+		Spec: snapshotv1beta1api.VolumeSnapshotSpec{
+			Source: snapshotv1beta1api.VolumeSnapshotSource{VolumeSnapshotContentName: &vsName},
+		},
+	}
+	if _, err := snapshotClient.VolumeSnapshots(namespace).Create(vs); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating volumesnapshot %s/%s", namespace, vsName)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	veleroclientset "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/exposer"
+)
+
+const (
+	// snapshotMoveDataAnnotation, set on a backup, opts a PVC into the data-mover
+	// path: instead of leaving the CSI snapshot in the cloud provider's account,
+	// its contents are streamed into the BSL via the running uploader.
+	snapshotMoveDataAnnotation = "backup.velero.io/snapshot-move-data"
+
+	// dataMoverSnapshotHandleAnnotation is set by this action on the backed-up
+	// PVC, recording the snapshot handle its exposing PVC was created from, so
+	// pvcMoveDataRestoreItemAction can rebind the restored PVC's PV to the same
+	// data. pvcMoveDataDeleteItemAction uses its presence to decide whether the
+	// PVC has exposing objects to clean up when the backup is deleted; it
+	// locates them by dataMoverExposeKey, not by the recorded handle.
+	dataMoverSnapshotHandleAnnotation = "backup.velero.io/snapshot-move-data-handle"
+)
+
+// pvcMoveDataBackupItemAction exposes a CSI VolumeSnapshot as a mountable PVC
+// in the Velero namespace when the owning backup is annotated with
+// snapshotMoveDataAnnotation, so the existing uploader (Kopia/Restic) can pick
+// it up and stream it to the BSL the same way it would a PodVolumeBackup.
+type pvcMoveDataBackupItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVCMoveDataBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvcMoveDataBackupItemAction{log: logger}, nil
+}
+
+func (p *pvcMoveDataBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+func (p *pvcMoveDataBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.log.Info("Starting pvcMoveDataBackupItemAction")
+
+	if backup.Annotations[snapshotMoveDataAnnotation] != "true" {
+		p.log.Debugf("Backup %s/%s is not annotated with %s, skipping data-mover handling", backup.Namespace, backup.Name, snapshotMoveDataAnnotation)
+		return item, nil, nil
+	}
+
+	var pvc corev1api.PersistentVolumeClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pvc); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating kube client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	pv, err := getPVForPVC(&pvc, kubeClient.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+	if pv.Spec.CSI == nil {
+		p.log.Infof("PV %s for PVC %s/%s is not a CSI volume, skipping data-mover handling", pv.Name, pvc.Namespace, pvc.Name)
+		return item, nil, nil
+	}
+
+	storageClassName := pv.Spec.StorageClassName
+	if storageClassName == "" {
+		return nil, nil, errors.Errorf("PVC %s/%s has no storageClassName set", pvc.Namespace, pvc.Name)
+	}
+
+	storageClass, err := kubeClient.StorageV1().StorageClasses().Get(storageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting storageclass %s for PVC %s/%s", storageClassName, pvc.Namespace, pvc.Name)
+	}
+
+	pluginConfig, err := getPluginConfig(backup.Namespace, kubeClient.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	veleroClient, err := veleroclientset.NewForConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating velero client")
+	}
+
+	selectors := podVolumeBackupSelectorsForConfig(pluginConfig, veleroClient, backup.Name)
+	claimed, err := isPVCBackedUpByPodVolumeBackup(pvc.Namespace, pvc.Name, kubeClient.CoreV1(), selectors)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claimed {
+		p.log.Infof("PVC %s/%s is already being backed up by a pod-volume-backup uploader, skipping data-mover handling", pvc.Namespace, pvc.Name)
+		return item, nil, nil
+	}
+
+	snapshotClass, err := getVolumeSnapshotClassForStorageClass(pv.Spec.CSI.Driver, &pvc, storageClass, backup.Name, pluginConfig, snapshotClient.SnapshotV1beta1(), p.log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vs := &snapshotv1beta1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pvc.Name + "-",
+			Namespace:    pvc.Namespace,
+		},
+		Spec: snapshotv1beta1api.VolumeSnapshotSpec{
+			VolumeSnapshotClassName: &snapshotClass.Name,
+			Source: snapshotv1beta1api.VolumeSnapshotSource{
+				PersistentVolumeClaimName: &pvc.Name,
+			},
+		},
+	}
+	vs, err = snapshotClient.SnapshotV1beta1().VolumeSnapshots(pvc.Namespace).Create(vs)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error creating volumesnapshot for PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	snapshotTimeout := snapshotTimeoutForConfig(pluginConfig, p.log)
+
+	ctx, cancel := contextForBackup(context.Background(), backup, veleroClient, p.log)
+	defer cancel()
+
+	vsc, err := getVolumeSnapshotContentForVolumeSnapshot(ctx, vs, snapshotClient.SnapshotV1beta1(), p.log, snapshotTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+		return nil, nil, errors.Errorf("volumesnapshotcontent %s for PVC %s/%s has no snapshot handle", vsc.Name, pvc.Namespace, pvc.Name)
+	}
+
+	pods, err := getPodsUsingPVC(pvc.Namespace, pvc.Name, kubeClient.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exp := exposer.New(kubeClient.CoreV1(), snapshotClient.SnapshotV1beta1(), p.log)
+
+	param := exposer.Param{
+		Key:                         dataMoverExposeKey(backup.Name, pvc.Namespace, pvc.Name),
+		OwnerPVCName:                pvc.Name,
+		SourceVolumeSnapshot:        vs,
+		SourceVolumeSnapshotContent: vsc,
+		VeleroNamespace:             backup.Namespace,
+		StorageClass:                storageClassName,
+		AccessModes:                 pvc.Spec.AccessModes,
+		Resources:                   pvc.Spec.Resources,
+		NodeSelector:                nodeSelectorForPods(pods),
+		Timeout:                     snapshotTimeout,
+	}
+
+	result, err := exp.Expose(context.Background(), param)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error exposing snapshot for PVC %s/%s for data-mover upload", pvc.Namespace, pvc.Name)
+	}
+
+	if err := exp.PeekExposed(context.Background(), param); err != nil {
+		return nil, nil, errors.Wrapf(err, "error waiting for exposed volume for PVC %s/%s to be ready for data-mover upload", pvc.Namespace, pvc.Name)
+	}
+
+	p.log.Infof("Exposed snapshot of PVC %s/%s as PVC %s/%s for data-mover upload", pvc.Namespace, pvc.Name, result.PVC.Namespace, result.PVC.Name)
+
+	additionalItems := []velero.ResourceIdentifier{
+		{
+			GroupResource: kuberesource.VolumeSnapshots,
+			Namespace:     vs.Namespace,
+			Name:          vs.Name,
+		},
+	}
+
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	pvc.Annotations[dataMoverSnapshotHandleAnnotation] = *vsc.Status.SnapshotHandle
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: updated}, additionalItems, nil
+}
+
+// nodeSelectorForPods returns a node selector pinning to the node the
+// original workload's pod(s) run on, if any, so the exposing pause pod can
+// bind a topology-constrained volume.
+func nodeSelectorForPods(pods []corev1api.Pod) map[string]string {
+	for _, pod := range pods {
+		if pod.Spec.NodeName != "" {
+			return map[string]string{"kubernetes.io/hostname": pod.Spec.NodeName}
+		}
+	}
+	return nil
+}
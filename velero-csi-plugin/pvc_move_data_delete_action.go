@@ -0,0 +1,73 @@
+package main
+
+import (
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/exposer"
+)
+
+// pvcMoveDataDeleteItemAction removes the exposing pod/PVC/VolumeSnapshot/
+// VolumeSnapshotContent that pvcMoveDataBackupItemAction created in the
+// Velero namespace, once the backup (and the data it covers) is deleted.
+// Without this, every data-mover backup permanently leaks those objects.
+type pvcMoveDataDeleteItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVCMoveDataDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvcMoveDataDeleteItemAction{log: logger}, nil
+}
+
+func (p *pvcMoveDataDeleteItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+func (p *pvcMoveDataDeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	p.log.Info("Starting pvcMoveDataDeleteItemAction")
+
+	var pvc corev1api.PersistentVolumeClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pvc); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, ok := pvc.Annotations[dataMoverSnapshotHandleAnnotation]; !ok {
+		p.log.Debugf("PVC %s/%s has no %s annotation, skipping data-mover cleanup", pvc.Namespace, pvc.Name, dataMoverSnapshotHandleAnnotation)
+		return nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "error creating kube client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	key := dataMoverExposeKey(input.Backup.Name, pvc.Namespace, pvc.Name)
+
+	exp := exposer.New(kubeClient.CoreV1(), snapshotClient.SnapshotV1beta1(), p.log)
+	if err := exp.CleanUp(key, input.Backup.Namespace); err != nil {
+		return errors.Wrapf(err, "error cleaning up exposed objects for PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	p.log.Infof("Cleaned up exposed objects for PVC %s/%s in namespace %s", pvc.Namespace, pvc.Name, input.Backup.Namespace)
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/exposer"
+)
+
+// pvcMoveDataRestoreItemAction is the restore-side counterpart to
+// pvcMoveDataBackupItemAction. A PVC restored from a data-mover backup can't
+// simply be recreated and left to a CSI driver to provision from the
+// snapshot, because the data lives in the BSL, not in the cloud provider's
+// snapshot store. Instead, this action creates the PVC itself against its
+// original StorageClass, waits for the CSI driver to dynamically provision
+// and bind a PV for it, then uses exposer.RebindVolume to swap that PV for a
+// statically-provisioned one pointing at the uploaded data's snapshot
+// handle. It returns SkipRestore so Velero doesn't also try to create the
+// PVC a second time.
+type pvcMoveDataRestoreItemAction struct {
+	log logrus.FieldLogger
+}
+
+func newPVCMoveDataRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &pvcMoveDataRestoreItemAction{log: logger}, nil
+}
+
+func (p *pvcMoveDataRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+func (p *pvcMoveDataRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.log.Info("Starting pvcMoveDataRestoreItemAction")
+
+	var pvc corev1api.PersistentVolumeClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pvc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	handle, ok := pvc.Annotations[dataMoverSnapshotHandleAnnotation]
+	if !ok {
+		p.log.Debugf("PVC %s/%s has no %s annotation, skipping data-mover rebind", pvc.Namespace, pvc.Name, dataMoverSnapshotHandleAnnotation)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting in-cluster config")
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating kube client")
+	}
+
+	snapshotClient, err := snapshotterClientSet.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating volumesnapshot client")
+	}
+
+	pluginConfig, err := getPluginConfig(input.Restore.Namespace, kubeClient.CoreV1())
+	if err != nil {
+		return nil, err
+	}
+	timeout := snapshotTimeoutForConfig(pluginConfig, p.log)
+
+	created, err := kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(&pvc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating PVC %s/%s for data-mover rebind", pvc.Namespace, pvc.Name)
+	}
+
+	bound, err := waitForPVCBound(context.Background(), created.Namespace, created.Name, kubeClient.CoreV1(), timeout, p.log)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error waiting for PVC %s/%s to bind before data-mover rebind", created.Namespace, created.Name)
+	}
+
+	exp := exposer.New(kubeClient.CoreV1(), snapshotClient.SnapshotV1beta1(), p.log)
+	if err := exp.RebindVolume(context.Background(), kubeClient.CoreV1(), bound, handle, bound.Spec.Resources.Requests[corev1api.ResourceStorage], timeout); err != nil {
+		return nil, errors.Wrapf(err, "error rebinding PV for restored PVC %s/%s to snapshot handle %q", bound.Namespace, bound.Name, handle)
+	}
+
+	p.log.Infof("PVC %s/%s: rebound to data-mover snapshot handle %q", bound.Namespace, bound.Name, handle)
+
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+	output.SkipRestore = true
+	return output, nil
+}
+
+// waitForPVCBound blocks, with a bounded exponential backoff, until pvcName
+// in pvcNamespace reports phase Bound, or until ctx is cancelled or timeout
+// elapses.
+func waitForPVCBound(ctx context.Context, pvcNamespace, pvcName string, corev1 corev1client.PersistentVolumeClaimsGetter, timeout time.Duration, log logrus.FieldLogger) (*corev1api.PersistentVolumeClaim, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.2,
+		Cap:      30 * time.Second,
+		Steps:    math.MaxInt32,
+	}
+
+	var bound *corev1api.PersistentVolumeClaim
+
+	pollErr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		pvc, err := corev1.PersistentVolumeClaims(pvcNamespace).Get(pvcName, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get PVC %s/%s", pvcNamespace, pvcName)
+		}
+
+		if pvc.Status.Phase != corev1api.ClaimBound {
+			log.Infof("Waiting for PVC %s/%s to be bound, currently %s", pvcNamespace, pvcName, pvc.Status.Phase)
+			return false, nil
+		}
+
+		bound = pvc
+		return true, nil
+	})
+
+	if pollErr != nil {
+		return nil, errors.Wrapf(pollErr, "timed out waiting for PVC %s/%s to be bound", pvcNamespace, pvcName)
+	}
+
+	return bound, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -10,14 +12,56 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	veleroclientset "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned"
 )
 
 const (
 	//TODO: use annotation from velero https://github.com/vmware-tanzu/velero/pull/2283
 	resticPodAnnotation = "backup.velero.io/backup-volumes"
+
+	resticPodVolumesExcludeAnnotation = "backup.velero.io/backup-volumes-excludes"
+
+	// pluginConfigLabel marks a ConfigMap in the Velero server namespace as
+	// holding configuration for this plugin, keyed by the plugin's name.
+	pluginConfigLabel = "velero.io/plugin-config"
+
+	pluginName = "velero.io/csi"
+
+	// uploaderTypeConfigKey selects which uploader (if any) is responsible for
+	// backing up pod volumes out of band of CSI snapshots: "restic" (the
+	// legacy default) or "kopia".
+	uploaderTypeConfigKey = "uploaderType"
+
+	uploaderTypeKopia = "kopia"
+
+	// snapshotTimeoutConfigKey configures how long to wait for a CSI driver to
+	// reconcile a VolumeSnapshot, mirroring Velero's --csi-snapshot-timeout.
+	snapshotTimeoutConfigKey = "snapshotTimeout"
+
+	defaultSnapshotTimeout = 10 * time.Minute
+
+	// volumeSnapshotClassAnnotation, set on a PVC or its StorageClass, pins the
+	// exact VolumeSnapshotClass to use, overriding every other selection tier.
+	volumeSnapshotClassAnnotation = "velero.io/csi-volumesnapshot-class"
+
+	// volumeSnapshotClassLabel, set on a VolumeSnapshotClass, opts it in for a
+	// specific backup (by name) or as the cluster-wide default.
+	volumeSnapshotClassLabel = "velero.io/csi-volumesnapshot-class"
+
+	isDefaultSnapshotClassAnnotation = "snapshot.storage.kubernetes.io/is-default-class"
+
+	// volumeSnapshotClassConfigKeyPrefix, combined with a driver name, is a
+	// plugin ConfigMap key pinning the default VolumeSnapshotClass for that
+	// driver cluster-wide, e.g. volumesnapshotclass-pd.csi.storage.gke.io.
+	volumeSnapshotClassConfigKeyPrefix = "volumesnapshotclass-"
 )
 
 func getPVForPVC(pvc *corev1api.PersistentVolumeClaim, corev1 corev1client.PersistentVolumesGetter) (*corev1api.PersistentVolume, error) {
@@ -63,14 +107,6 @@ func getPodVolumeNameForPVC(pod corev1api.Pod, pvcName string) (string, error) {
 	return "", errors.Errorf("Pod %s/%s does not use PVC %s/%s", pod.Namespace, pod.Name, pod.Namespace, pvcName)
 }
 
-func getPodVolumesUsingRestic(pod corev1api.Pod) []string {
-	resticAnnotation := pod.Annotations[resticPodAnnotation]
-	if resticAnnotation == "" {
-		return []string{}
-	}
-	return strings.Split(pod.Annotations[resticPodAnnotation], ",")
-}
-
 func contains(slice []string, key string) bool {
 	for _, i := range slice {
 		if i == key {
@@ -80,20 +116,102 @@ func contains(slice []string, key string) bool {
 	return false
 }
 
-func isPVCBackedUpByRestic(pvcNamespace, pvcName string, podClient corev1client.PodsGetter) (bool, error) {
+// podVolumeBackupSelector decides whether a pod's volume is already being (or
+// will be) backed up by a pod-volume-backup-style uploader, in which case the
+// CSI plugin should skip snapshotting it to avoid double-backing-up the data.
+type podVolumeBackupSelector interface {
+	isVolumeSelected(pod corev1api.Pod, volumeName string) (bool, error)
+}
+
+// legacyOptInPodVolumeBackupSelector selects volumes a pod has opted into via
+// the deprecated, comma-separated backup.velero.io/backup-volumes annotation.
+// This is restic's original, opt-in default.
+type legacyOptInPodVolumeBackupSelector struct{}
+
+func (s *legacyOptInPodVolumeBackupSelector) isVolumeSelected(pod corev1api.Pod, volumeName string) (bool, error) {
+	included := pod.Annotations[resticPodAnnotation]
+	if included == "" {
+		return false, nil
+	}
+	return contains(strings.Split(included, ","), volumeName), nil
+}
+
+// optOutPodVolumeBackupSelector selects every pod volume except those a pod
+// has opted out of via backup.velero.io/backup-volumes-excludes. This backs
+// restic/kopia's newer opt-out default, where PVBR backs up all pod volumes
+// unless told otherwise.
+type optOutPodVolumeBackupSelector struct{}
+
+func (s *optOutPodVolumeBackupSelector) isVolumeSelected(pod corev1api.Pod, volumeName string) (bool, error) {
+	excluded := pod.Annotations[resticPodVolumesExcludeAnnotation]
+	if excluded == "" {
+		return true, nil
+	}
+	return !contains(strings.Split(excluded, ","), volumeName), nil
+}
+
+// podVolumeBackupCRSelector selects volumes that already have a Velero
+// PodVolumeBackup CR recorded for the in-progress backup. This is the source
+// of truth once the Kopia uploader owns pod volume backups end-to-end, rather
+// than relying on pod annotations the uploader may not set.
+type podVolumeBackupCRSelector struct {
+	veleroClient veleroclientset.Interface
+	backupName   string
+}
+
+func (s *podVolumeBackupCRSelector) isVolumeSelected(pod corev1api.Pod, volumeName string) (bool, error) {
+	pvbs, err := s.veleroClient.VeleroV1().PodVolumeBackups(pod.Namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("velero.io/backup-name=%s", s.backupName),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing podvolumebackups for backup %s", s.backupName)
+	}
+
+	for _, pvb := range pvbs.Items {
+		if pvb.Spec.Pod.Namespace == pod.Namespace && pvb.Spec.Pod.Name == pod.Name && pvb.Spec.Volume == volumeName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// podVolumeBackupSelectorsForConfig returns the selectors that should be
+// consulted for the given plugin config, keyed by the uploaderType config map
+// value. Kopia clusters are checked against the opt-out annotation and the
+// PodVolumeBackup CRs the uploader creates; restic clusters default to the
+// legacy opt-in annotation.
+func podVolumeBackupSelectorsForConfig(config map[string]string, veleroClient veleroclientset.Interface, backupName string) []podVolumeBackupSelector {
+	if config[uploaderTypeConfigKey] == uploaderTypeKopia {
+		return []podVolumeBackupSelector{
+			&optOutPodVolumeBackupSelector{},
+			&podVolumeBackupCRSelector{veleroClient: veleroClient, backupName: backupName},
+		}
+	}
+	return []podVolumeBackupSelector{&legacyOptInPodVolumeBackupSelector{}}
+}
+
+// isPVCBackedUpByPodVolumeBackup returns true if any pod using pvcName has a
+// volume that at least one of the given selectors claims is already handled
+// by a pod-volume-backup-style uploader, so the CSI plugin should skip it.
+func isPVCBackedUpByPodVolumeBackup(pvcNamespace, pvcName string, podClient corev1client.PodsGetter, selectors []podVolumeBackupSelector) (bool, error) {
 	pods, err := getPodsUsingPVC(pvcNamespace, pvcName, podClient)
 	if err != nil {
 		return false, errors.WithStack(err)
 	}
 
-	for _, p := range pods {
-		resticVols := getPodVolumesUsingRestic(p)
-		if len(resticVols) > 0 {
-			volName, err := getPodVolumeNameForPVC(p, pvcName)
+	for _, pod := range pods {
+		volName, err := getPodVolumeNameForPVC(pod, pvcName)
+		if err != nil {
+			return false, err
+		}
+
+		for _, selector := range selectors {
+			selected, err := selector.isVolumeSelected(pod, volName)
 			if err != nil {
 				return false, err
 			}
-			if contains(resticVols, volName) {
+			if selected {
 				return true, nil
 			}
 		}
@@ -102,40 +220,281 @@ func isPVCBackedUpByRestic(pvcNamespace, pvcName string, podClient corev1client.
 	return false, nil
 }
 
-func getVolumeSnapshotClassForStorageClass(provisioner string, snapshotClient snapshotter.SnapshotV1beta1Interface) (*snapshotv1beta1api.VolumeSnapshotClass, error) {
+// getPluginConfig returns the data of the ConfigMap in namespace labeled
+// velero.io/plugin-config=true that also carries a label keyed by this
+// plugin's name (velero.io/csi, any value), or an empty map if no
+// such ConfigMap exists. Velero convention is that operators drop at most one
+// such ConfigMap per plugin per server namespace to configure it.
+func getPluginConfig(namespace string, cmClient corev1client.ConfigMapsGetter) (map[string]string, error) {
+	cmList, err := cmClient.ConfigMaps(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=true,%s", pluginConfigLabel, pluginName),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing plugin config maps")
+	}
+	if len(cmList.Items) == 0 {
+		return map[string]string{}, nil
+	}
+
+	return cmList.Items[0].Data, nil
+}
+
+// getVolumeSnapshotClassForStorageClass resolves which VolumeSnapshotClass to
+// use for a PVC provisioned by the given driver. Earlier tiers let operators
+// and application owners pin a specific class; later tiers fall back to
+// cluster-wide conventions, and finally to the original first-match-by-driver
+// behavior (now with a warning, since it's nondeterministic when a cluster has
+// more than one class per driver):
+//
+//  1. the PVC's velero.io/csi-volumesnapshot-class annotation
+//  2. the StorageClass's velero.io/csi-volumesnapshot-class annotation
+//  3. a VolumeSnapshotClass labeled velero.io/csi-volumesnapshot-class=<backupName>, or =default
+//  4. the plugin ConfigMap key volumesnapshotclass-<driver>
+//  5. a VolumeSnapshotClass annotated snapshot.storage.kubernetes.io/is-default-class=true for driver
+//  6. the first VolumeSnapshotClass found for driver
+func getVolumeSnapshotClassForStorageClass(driver string, pvc *corev1api.PersistentVolumeClaim, storageClass *storagev1api.StorageClass, backupName string, config map[string]string, snapshotClient snapshotter.SnapshotV1beta1Interface, log logrus.FieldLogger) (*snapshotv1beta1api.VolumeSnapshotClass, error) {
+	if name := pvc.Annotations[volumeSnapshotClassAnnotation]; name != "" {
+		return getNamedVolumeSnapshotClassForDriver(name, driver, snapshotClient)
+	}
+
+	if name := storageClass.Annotations[volumeSnapshotClassAnnotation]; name != "" {
+		return getNamedVolumeSnapshotClassForDriver(name, driver, snapshotClient)
+	}
+
 	snapshotClasses, err := snapshotClient.VolumeSnapshotClasses().List(metav1.ListOptions{})
 	if err != nil {
 		return nil, errors.Wrap(err, "error listing volumesnapshot classes")
 	}
+
+	for _, label := range []string{backupName, "default"} {
+		for _, sc := range snapshotClasses.Items {
+			if sc.Driver == driver && sc.Labels[volumeSnapshotClassLabel] == label {
+				return &sc, nil
+			}
+		}
+	}
+
+	if name := config[volumeSnapshotClassConfigKeyPrefix+driver]; name != "" {
+		return getNamedVolumeSnapshotClassForDriver(name, driver, snapshotClient)
+	}
+
 	for _, sc := range snapshotClasses.Items {
-		if sc.Driver == provisioner {
+		if sc.Driver == driver && sc.Annotations[isDefaultSnapshotClassAnnotation] == "true" {
 			return &sc, nil
 		}
 	}
-	return nil, errors.Errorf("failed to get volumesnapshotclass for provisioner %s", provisioner)
+
+	for _, sc := range snapshotClasses.Items {
+		if sc.Driver == driver {
+			log.Warnf("Found volumesnapshotclass %s for driver %s by first match; consider labeling/annotating a volumesnapshotclass to pin this explicitly", sc.Name, driver)
+			return &sc, nil
+		}
+	}
+
+	return nil, errors.Errorf("failed to get volumesnapshotclass for provisioner %s", driver)
+}
+
+// getNamedVolumeSnapshotClassForDriver looks up a VolumeSnapshotClass by name
+// and verifies it's actually for the expected driver, so a PVC or StorageClass
+// annotation pointing at a mismatched class fails loudly instead of silently
+// snapshotting with the wrong driver's class.
+func getNamedVolumeSnapshotClassForDriver(name, driver string, snapshotClient snapshotter.SnapshotV1beta1Interface) (*snapshotv1beta1api.VolumeSnapshotClass, error) {
+	vsClass, err := snapshotClient.VolumeSnapshotClasses().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting volumesnapshotclass %s", name)
+	}
+	if vsClass.Driver != driver {
+		return nil, errors.Errorf("volumesnapshotclass %s has driver %s, expected %s", name, vsClass.Driver, driver)
+	}
+	return vsClass, nil
 }
 
-func getVolumeSnapshotContentForVolumeSnapshot(volSnap *snapshotv1beta1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1beta1Interface, log logrus.FieldLogger) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+// getVolumeSnapshotContentForVolumeSnapshot blocks until the CSI driver has
+// reconciled volSnap and bound it to a VolumeSnapshotContent, polling with an
+// exponential backoff (starting at 1s, capped at 30s, with 0.2 jitter so
+// concurrent backups of many PVCs don't all hammer the API server in lockstep)
+// until either it succeeds, ctx is cancelled, or timeout elapses.
+func getVolumeSnapshotContentForVolumeSnapshot(ctx context.Context, volSnap *snapshotv1beta1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1beta1Interface, log logrus.FieldLogger, timeout time.Duration) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.2,
+		Cap:      30 * time.Second,
+		Steps:    math.MaxInt32,
+	}
+
 	var snapshotContent *snapshotv1beta1api.VolumeSnapshotContent
-	for {
+	var lastObserved *snapshotv1beta1api.VolumeSnapshot
+
+	pollErr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
 		vs, err := snapshotClient.VolumeSnapshots(volSnap.Namespace).Get(volSnap.Name, metav1.GetOptions{})
 		if err != nil {
-			return nil, errors.Wrapf(err, fmt.Sprintf("failed to get volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name))
+			return false, errors.Wrapf(err, "failed to get volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name)
 		}
+		lastObserved = vs
 
-		// TODO: add timeout
 		if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
-			log.Infof("Waiting for CSI driver to reconcile volumesnapshot %s/%s. Retrying in 5s", volSnap.Namespace, volSnap.Name)
-			time.Sleep(5 * time.Second)
-			continue
+			log.Infof("Waiting for CSI driver to reconcile volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name)
+			return false, nil
 		}
-		snapshotContent, err = snapshotClient.VolumeSnapshotContents().Get(*vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+
+		content, err := snapshotClient.VolumeSnapshotContents().Get(*vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
 		if err != nil {
-			return nil, errors.Wrapf(err, fmt.Sprintf("failed to get volumesnapshotcontent %s for volumesnapshot %s/%s", *vs.Status.BoundVolumeSnapshotContentName, volSnap.Namespace, volSnap.Name))
+			return false, errors.Wrapf(err, "failed to get volumesnapshotcontent %s for volumesnapshot %s/%s", *vs.Status.BoundVolumeSnapshotContentName, volSnap.Namespace, volSnap.Name)
 		}
 
-		break
+		snapshotContent = content
+		return true, nil
+	})
+
+	if pollErr != nil {
+		if lastObserved != nil && lastObserved.Status != nil && lastObserved.Status.Error != nil {
+			return nil, errors.Wrapf(pollErr, "timed out waiting for volumesnapshot %s/%s to be ready: driver reported error %q at %s",
+				volSnap.Namespace, volSnap.Name, derefString(lastObserved.Status.Error.Message), derefTime(lastObserved.Status.Error.Time))
+		}
+		return nil, errors.Wrapf(pollErr, "timed out waiting for volumesnapshot %s/%s to be ready", volSnap.Namespace, volSnap.Name)
 	}
 
 	return snapshotContent, nil
 }
+
+// waitForVolumeSnapshotReady is the restore-side counterpart to
+// getVolumeSnapshotContentForVolumeSnapshot: it blocks, with the same
+// exponential backoff, until the pre-provisioned VolumeSnapshot vsName/vsNamespace
+// is bound to a VolumeSnapshotContent that reports ReadyToUse, or until ctx is
+// cancelled or timeout elapses.
+func waitForVolumeSnapshotReady(ctx context.Context, vsNamespace, vsName string, snapshotClient snapshotter.SnapshotV1beta1Interface, timeout time.Duration, log logrus.FieldLogger) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.2,
+		Cap:      30 * time.Second,
+		Steps:    math.MaxInt32,
+	}
+
+	var snapshotContent *snapshotv1beta1api.VolumeSnapshotContent
+	var lastObserved *snapshotv1beta1api.VolumeSnapshot
+
+	pollErr := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		vs, err := snapshotClient.VolumeSnapshots(vsNamespace).Get(vsName, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumesnapshot %s/%s", vsNamespace, vsName)
+		}
+		lastObserved = vs
+
+		if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
+			log.Infof("Waiting for volumesnapshot %s/%s to be bound", vsNamespace, vsName)
+			return false, nil
+		}
+
+		content, err := snapshotClient.VolumeSnapshotContents().Get(*vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumesnapshotcontent %s for volumesnapshot %s/%s", *vs.Status.BoundVolumeSnapshotContentName, vsNamespace, vsName)
+		}
+
+		if content.Status == nil || content.Status.ReadyToUse == nil || !*content.Status.ReadyToUse {
+			log.Infof("Waiting for volumesnapshotcontent %s for volumesnapshot %s/%s to be ready to use", content.Name, vsNamespace, vsName)
+			return false, nil
+		}
+
+		snapshotContent = content
+		return true, nil
+	})
+
+	if pollErr != nil {
+		if lastObserved != nil && lastObserved.Status != nil && lastObserved.Status.Error != nil {
+			return nil, errors.Wrapf(pollErr, "timed out waiting for volumesnapshot %s/%s to be ready: driver reported error %q at %s",
+				vsNamespace, vsName, derefString(lastObserved.Status.Error.Message), derefTime(lastObserved.Status.Error.Time))
+		}
+		return nil, errors.Wrapf(pollErr, "timed out waiting for volumesnapshot %s/%s to be ready", vsNamespace, vsName)
+	}
+
+	return snapshotContent, nil
+}
+
+// snapshotTimeoutForConfig returns the plugin-configured snapshotTimeout,
+// mirroring Velero's --csi-snapshot-timeout, or defaultSnapshotTimeout if the
+// config doesn't set one or sets an unparseable value.
+func snapshotTimeoutForConfig(config map[string]string, log logrus.FieldLogger) time.Duration {
+	raw, ok := config[snapshotTimeoutConfigKey]
+	if !ok {
+		return defaultSnapshotTimeout
+	}
+
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Warnf("Unable to parse %s value %q, using default of %s: %v", snapshotTimeoutConfigKey, raw, defaultSnapshotTimeout, err)
+		return defaultSnapshotTimeout
+	}
+
+	return timeout
+}
+
+// contextForBackup returns a context derived from ctx that's additionally
+// cancelled as soon as backup is observed deleted or transitioning to phase
+// Deleting, so a long-running wait like getVolumeSnapshotContentForVolumeSnapshot
+// stops as soon as the backup itself is cancelled instead of running all the
+// way to its own fixed timeout. BackupItemAction.Execute isn't handed a
+// context of its own, so polling the Backup object is the best cancellation
+// signal available to it.
+func contextForBackup(ctx context.Context, backup *velerov1api.Backup, veleroClient veleroclientset.Interface, log logrus.FieldLogger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current, err := veleroClient.VeleroV1().Backups(backup.Namespace).Get(backup.Name, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					log.Infof("Backup %s/%s was deleted, cancelling in-progress wait", backup.Namespace, backup.Name)
+					cancel()
+					return
+				}
+				if err != nil {
+					log.Warnf("Error checking backup %s/%s for cancellation: %v", backup.Namespace, backup.Name, err)
+					continue
+				}
+				if current.DeletionTimestamp != nil || current.Status.Phase == velerov1api.BackupPhaseDeleting {
+					log.Infof("Backup %s/%s is being cancelled, cancelling in-progress wait", backup.Namespace, backup.Name)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// dataMoverExposeKey deterministically derives the exposer.Param.Key for the
+// data-mover objects exposing a given PVC's snapshot for a given backup, so
+// pvcMoveDataBackupItemAction and pvcMoveDataDeleteItemAction agree on the
+// same name without coordinating out of band.
+func dataMoverExposeKey(backupName, pvcNamespace, pvcName string) string {
+	return backupName + "-" + pvcNamespace + "-" + pvcName
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return "unknown error"
+	}
+	return *s
+}
+
+func derefTime(t *metav1.Time) string {
+	if t == nil {
+		return "unknown time"
+	}
+	return t.String()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/v2/pkg/apis/volumesnapshot/v1beta1"
+	snapshotfake "github.com/kubernetes-csi/external-snapshotter/v2/pkg/client/clientset/versioned/fake"
+	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func vsClass(name, driver string, labels, annotations map[string]string) *snapshotv1beta1api.VolumeSnapshotClass {
+	return &snapshotv1beta1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Driver: driver,
+	}
+}
+
+func TestGetVolumeSnapshotClassForStorageClass(t *testing.T) {
+	const driver = "disk.csi.example.com"
+	const otherDriver = "other.csi.example.com"
+
+	tests := []struct {
+		name       string
+		pvc        *corev1api.PersistentVolumeClaim
+		sc         *storagev1api.StorageClass
+		backupName string
+		config     map[string]string
+		objects    []runtime.Object
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "tier 1: PVC annotation wins over everything else",
+			pvc: &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{volumeSnapshotClassAnnotation: "pvc-pinned"},
+				},
+			},
+			sc: &storagev1api.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{volumeSnapshotClassAnnotation: "sc-pinned"}},
+			},
+			objects: []runtime.Object{
+				vsClass("pvc-pinned", driver, nil, nil),
+				vsClass("sc-pinned", driver, nil, nil),
+			},
+			want: "pvc-pinned",
+		},
+		{
+			name: "tier 2: StorageClass annotation used when PVC has none",
+			pvc:  &corev1api.PersistentVolumeClaim{},
+			sc: &storagev1api.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{volumeSnapshotClassAnnotation: "sc-pinned"}},
+			},
+			objects: []runtime.Object{vsClass("sc-pinned", driver, nil, nil)},
+			want:    "sc-pinned",
+		},
+		{
+			name:       "tier 3: label matching the backup name",
+			pvc:        &corev1api.PersistentVolumeClaim{},
+			sc:         &storagev1api.StorageClass{},
+			backupName: "my-backup",
+			objects: []runtime.Object{
+				vsClass("for-this-backup", driver, map[string]string{volumeSnapshotClassLabel: "my-backup"}, nil),
+			},
+			want: "for-this-backup",
+		},
+		{
+			name:       "tier 3: label \"default\" used when no backup-name label matches",
+			pvc:        &corev1api.PersistentVolumeClaim{},
+			sc:         &storagev1api.StorageClass{},
+			backupName: "my-backup",
+			objects: []runtime.Object{
+				vsClass("labeled-default", driver, map[string]string{volumeSnapshotClassLabel: "default"}, nil),
+			},
+			want: "labeled-default",
+		},
+		{
+			name:   "tier 4: plugin ConfigMap override keyed by driver",
+			pvc:    &corev1api.PersistentVolumeClaim{},
+			sc:     &storagev1api.StorageClass{},
+			config: map[string]string{volumeSnapshotClassConfigKeyPrefix + driver: "configmap-pinned"},
+			objects: []runtime.Object{
+				vsClass("configmap-pinned", driver, nil, nil),
+			},
+			want: "configmap-pinned",
+		},
+		{
+			name: "tier 5: is-default-class annotation",
+			pvc:  &corev1api.PersistentVolumeClaim{},
+			sc:   &storagev1api.StorageClass{},
+			objects: []runtime.Object{
+				vsClass("the-default", driver, nil, map[string]string{isDefaultSnapshotClassAnnotation: "true"}),
+			},
+			want: "the-default",
+		},
+		{
+			name: "tier 6: first match by driver, as a last resort",
+			pvc:  &corev1api.PersistentVolumeClaim{},
+			sc:   &storagev1api.StorageClass{},
+			objects: []runtime.Object{
+				vsClass("only-match", driver, nil, nil),
+				vsClass("wrong-driver", otherDriver, nil, nil),
+			},
+			want: "only-match",
+		},
+		{
+			name:    "no matching class for driver is an error",
+			pvc:     &corev1api.PersistentVolumeClaim{},
+			sc:      &storagev1api.StorageClass{},
+			objects: []runtime.Object{vsClass("wrong-driver", otherDriver, nil, nil)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := snapshotfake.NewSimpleClientset(tc.objects...)
+			log := logrus.New()
+
+			got, err := getVolumeSnapshotClassForStorageClass(driver, tc.pvc, tc.sc, tc.backupName, tc.config, client.SnapshotV1beta1(), log)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Name != tc.want {
+				t.Errorf("got volumesnapshotclass %q, want %q", got.Name, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetNamedVolumeSnapshotClassForDriver(t *testing.T) {
+	const driver = "disk.csi.example.com"
+	const otherDriver = "other.csi.example.com"
+
+	t.Run("matching driver", func(t *testing.T) {
+		client := snapshotfake.NewSimpleClientset(vsClass("my-class", driver, nil, nil))
+
+		got, err := getNamedVolumeSnapshotClassForDriver("my-class", driver, client.SnapshotV1beta1())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Name != "my-class" {
+			t.Errorf("got volumesnapshotclass %q, want %q", got.Name, "my-class")
+		}
+	})
+
+	t.Run("mismatched driver is an error", func(t *testing.T) {
+		client := snapshotfake.NewSimpleClientset(vsClass("my-class", otherDriver, nil, nil))
+
+		_, err := getNamedVolumeSnapshotClassForDriver("my-class", driver, client.SnapshotV1beta1())
+		if err == nil {
+			t.Fatal("expected an error for a volumesnapshotclass with a mismatched driver, got none")
+		}
+	})
+
+	t.Run("nonexistent class is an error", func(t *testing.T) {
+		client := snapshotfake.NewSimpleClientset()
+
+		_, err := getNamedVolumeSnapshotClassForDriver("missing-class", driver, client.SnapshotV1beta1())
+		if err == nil {
+			t.Fatal("expected an error for a nonexistent volumesnapshotclass, got none")
+		}
+	})
+}